@@ -7,12 +7,18 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/golang/glog"
+	"gopkg.in/fsnotify.v1"
 	"k8s.io/kubernetes/pkg/admission"
 	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
 	clientset "k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset"
+	"k8s.io/kubernetes/pkg/labels"
 )
 
 // This plugin perform the following tasks
@@ -26,8 +32,11 @@ import (
 // In this file, we're going to scan for the key specified by FlavorConfigFile, and its value specifies
 // the location of file that described the list of supported flavors.
 
-// This is an example configuration file with a list of supported flavors
+// This is an example configuration file with a list of supported flavors. "version" is optional and
+// defaults to 1; version 2 is the schema with the range and set selectors below. The parser records
+// the version but does not check it, so every selector style parses under either version.
 //{
+//	"version": 1,
 //	"flavors": {
 //		"pico": {
 //			"memory": "64Mi",
@@ -67,26 +76,448 @@ import (
 //		}
 //	}
 //}
+//
+// Each resource dimension of a flavor may also be expressed as a range or a set instead of a
+// single exact quantity, e.g. to describe the FLUIDOS K8slice flavors:
+//{
+//	"version": 2,
+//	"flavors": {
+//		"k8slice-small": {
+//			"cpu": {"min": "1", "max": "4", "step": "1"},
+//			"memory": ["1Gi", "2Gi", "4Gi"]
+//		}
+//	}
+//}
+// A pod requesting cpu=2, memory=2Gi matches "k8slice-small" above. A pod requesting only
+// cpu=2 is filled in with memory=1Gi, the first (and therefore default) value of the set.
+//
+// A "clusterFlavorPolicy" section may restrict which flavors a namespace can use, in the same
+// spirit as OpenShift's ClusterResourceOverride plugin:
+//{
+//	"flavors": { "...": "..." },
+//	"clusterFlavorPolicy": {
+//		"rules": [
+//			{
+//				"name": "batch-namespaces",
+//				"namespaceSelector": {"team": "batch"},
+//				"allowedFlavors": ["pico", "nano"],
+//				"defaultFlavor": "pico"
+//			},
+//			{
+//				"name": "kube-system",
+//				"namespaces": ["kube-system"],
+//				"allowedFlavors": ["large", "xlarge"]
+//			}
+//		]
+//	}
+//}
+// Namespaces matched by a rule (by explicit name or by label selector) may only use flavors in
+// that rule's allowedFlavors; namespaces matched by no rule may use any flavor in the catalog. A
+// pod may also carry the annotation "flavor.kubernetes.io/name=<flavorName>" to require an exact
+// match against that one flavor, filling in any dimension it omits from that flavor's values; this
+// is subject to the same namespace restriction.
+//
+// "matchingPolicy" picks how a request that doesn't land on a flavor exactly is treated:
+//   - "Strict" (the default): reject, as described above.
+//   - "RoundUp": mutate the request up to the smallest flavor that dominates it in every
+//     dimension (every requested value <= the flavor's value), rejecting only if none does.
+//   - "Nearest": mutate the request to the dominating flavor with the smallest weighted
+//     distance, where distance is the sum over dimensions of (flavorVal-reqVal)/reqVal times
+//     that dimension's weight in "resourceWeights" (default weight 1). A pod can opt out of
+//     Nearest back to Strict behavior by setting the annotation
+//     "flavor.kubernetes.io/disable-nearest" to "true"; any other value is ignored.
+// RoundUp and Nearest make this plugin a mutating admission step: it changes Resources.Requests
+// (and, when "setLimitsFromFlavor" is true, Resources.Limits) to the chosen flavor's values.
+//{
+//	"flavors": { "...": "..." },
+//	"matchingPolicy": "Nearest",
+//	"setLimitsFromFlavor": true,
+//	"resourceWeights": {"memory": 1, "cpu": 2}
+//}
+//
+// A flavor entry may also be a {"required", "extendedResources"} object instead of a flat
+// dimension map, to describe GPUs, hugepages, and other extended resources a flavor may (but
+// need not) carry. "required" is the flat dimension map from earlier examples; a container may
+// only request extended resources listed in "extendedResources", and any dimension -- required
+// or extended -- not declared by the chosen flavor at all is rejected:
+//{
+//	"flavors": {
+//		"gpu-large": {
+//			"required": {"memory": "4096Mi", "cpu": "1"},
+//			"extendedResources": {
+//				"nvidia.com/gpu": ["1", "2", "4"],
+//				"hugepages-2Mi": {"min": "0", "max": "2Gi", "step": "2Mi"}
+//			}
+//		}
+//	}
+//}
+//
+// "accounting" selects whether flavors are matched per container (the default, "PerContainer",
+// described above) or against a single aggregate computed across the whole pod ("PerPod"). In
+// PerPod mode the aggregate is computed the way the kubelet sizes a pod's sandbox -- the max,
+// dimension by dimension, across InitContainers, combined with the sum, dimension by dimension,
+// across Containers -- and matched (validating only; it is never mutated) against "podFlavors",
+// a second catalog with the same shape as "flavors":
+//{
+//	"accounting": "PerPod",
+//	"podFlavors": {
+//		"pod-small": {"memory": "512Mi", "cpu": "500m"}
+//	}
+//}
 
 const (
 	FlavorConfigFile = "flavor.config"
+
+	// currentFlavorConfigVersion is bumped whenever the flavor config schema gains new
+	// capabilities. Config files that omit "version" are treated as version 1.
+	currentFlavorConfigVersion = 2
+
+	// flavorAnnotation lets a pod request a specific flavor by name instead of being matched
+	// against the catalog automatically.
+	flavorAnnotation = "flavor.kubernetes.io/name"
+
+	// disableNearestAnnotation opts a pod out of the Nearest matching policy back to Strict,
+	// rejecting instead of being mutated onto the closest dominating flavor.
+	disableNearestAnnotation = "flavor.kubernetes.io/disable-nearest"
+)
+
+// matchingPolicy selects how Admit treats a request that doesn't land on a flavor exactly.
+type matchingPolicy string
+
+const (
+	// MatchingStrict rejects any request that doesn't exactly match a flavor (after defaults
+	// are filled in). This is the default and the plugin's original behavior.
+	MatchingStrict matchingPolicy = "Strict"
+	// MatchingRoundUp mutates the request up to the smallest dominating flavor.
+	MatchingRoundUp matchingPolicy = "RoundUp"
+	// MatchingNearest mutates the request to the dominating flavor with the smallest weighted
+	// distance.
+	MatchingNearest matchingPolicy = "Nearest"
+)
+
+// accountingMode selects what Admit matches flavors against.
+type accountingMode string
+
+const (
+	// AccountingPerContainer matches each container's request against "flavors" independently.
+	// This is the default and the plugin's original behavior.
+	AccountingPerContainer accountingMode = "PerContainer"
+	// AccountingPerPod matches a single aggregate, computed across the whole pod with kubelet's
+	// effective-resource semantics, against "podFlavors".
+	AccountingPerPod accountingMode = "PerPod"
 )
 
 func init() {
 	admission.RegisterPlugin("Flavor", func(client clientset.Interface, config io.Reader) (admission.Interface, error) {
-		return NewFlavor(config), nil
+		return NewFlavor(client, config)
 	})
 }
 
 type flavorType string
 
+// resourceSelectorKind identifies which of the selector styles a resourceSelector holds.
+type resourceSelectorKind int
+
+const (
+	selectorExact resourceSelectorKind = iota
+	selectorRange
+	selectorSet
+)
+
+// resourceSelector is the set of values a single resource dimension of a flavor will accept. It
+// unmarshals from whichever of the three styles is present in the config file:
+//   - a bare quantity string, e.g. "100m"                          -> exact match
+//   - a {"min", "max", "step"} object, e.g. {"min":"1","max":"4"}  -> range match
+//   - an array of quantity strings, e.g. ["1Gi", "2Gi", "4Gi"]     -> set match
+type resourceSelector struct {
+	kind resourceSelectorKind
+
+	exact resource.Quantity
+
+	min  resource.Quantity
+	max  resource.Quantity
+	step resource.Quantity
+
+	set []resource.Quantity
+}
+
+// rangeSelector is the on-the-wire shape of a range resourceSelector.
+type rangeSelector struct {
+	Min  string `json:"min"`
+	Max  string `json:"max"`
+	Step string `json:"step"`
+}
+
+func (s *resourceSelector) UnmarshalJSON(data []byte) error {
+	var exact string
+	if err := json.Unmarshal(data, &exact); err == nil {
+		q, err := resource.ParseQuantity(exact)
+		if err != nil {
+			return fmt.Errorf("invalid quantity %q: %v", exact, err)
+		}
+		s.kind = selectorExact
+		s.exact = q
+		return nil
+	}
+
+	var set []string
+	if err := json.Unmarshal(data, &set); err == nil {
+		if len(set) == 0 {
+			return fmt.Errorf("set selector must list at least one value")
+		}
+		quantities := make([]resource.Quantity, 0, len(set))
+		for _, v := range set {
+			q, err := resource.ParseQuantity(v)
+			if err != nil {
+				return fmt.Errorf("invalid quantity %q: %v", v, err)
+			}
+			quantities = append(quantities, q)
+		}
+		s.kind = selectorSet
+		s.set = quantities
+		return nil
+	}
+
+	var rng rangeSelector
+	if err := json.Unmarshal(data, &rng); err != nil {
+		return fmt.Errorf("resource selector must be a quantity, a set of quantities, or a {min,max,step} range: %v", err)
+	}
+	min, err := resource.ParseQuantity(rng.Min)
+	if err != nil {
+		return fmt.Errorf("invalid range min %q: %v", rng.Min, err)
+	}
+	max, err := resource.ParseQuantity(rng.Max)
+	if err != nil {
+		return fmt.Errorf("invalid range max %q: %v", rng.Max, err)
+	}
+	if min.Cmp(max) > 0 {
+		return fmt.Errorf("range min %v must not exceed max %v", min, max)
+	}
+	step := resource.MustParse("1")
+	if rng.Step != "" {
+		if step, err = resource.ParseQuantity(rng.Step); err != nil {
+			return fmt.Errorf("invalid range step %q: %v", rng.Step, err)
+		}
+	}
+	s.kind = selectorRange
+	s.min, s.max, s.step = min, max, step
+	return nil
+}
+
+// matches reports whether q is one of the values this selector accepts.
+func (s *resourceSelector) matches(q resource.Quantity) bool {
+	switch s.kind {
+	case selectorExact:
+		return s.exact.Cmp(q) == 0
+	case selectorSet:
+		for _, v := range s.set {
+			if v.Cmp(q) == 0 {
+				return true
+			}
+		}
+		return false
+	case selectorRange:
+		if q.Cmp(s.min) < 0 || q.Cmp(s.max) > 0 {
+			return false
+		}
+		if s.step.MilliValue() <= 0 {
+			return true
+		}
+		return (q.MilliValue()-s.min.MilliValue())%s.step.MilliValue() == 0
+	default:
+		return false
+	}
+}
+
+// defaultValue is used to fill in this dimension when a pod's request omits it entirely: the
+// range minimum, the first (and therefore default) element of a set, or the only value an exact
+// selector accepts.
+func (s *resourceSelector) defaultValue() resource.Quantity {
+	switch s.kind {
+	case selectorRange:
+		return s.min
+	case selectorSet:
+		return s.set[0]
+	default:
+		return s.exact
+	}
+}
+
+// upperBound is the largest value this selector can ever supply: the range maximum, the largest
+// set element, or the only value an exact selector accepts. dominates uses this (not
+// defaultValue, which is the smallest/default value) to decide whether a flavor can cover a
+// request at all.
+func (s *resourceSelector) upperBound() resource.Quantity {
+	switch s.kind {
+	case selectorRange:
+		return s.max
+	case selectorSet:
+		best := s.set[0]
+		for _, v := range s.set[1:] {
+			if v.Cmp(best) > 0 {
+				best = v
+			}
+		}
+		return best
+	default:
+		return s.exact
+	}
+}
+
+// ceiling is the smallest value this selector accepts that is still >= req: the smallest on-step
+// range value no smaller than req, req itself for a continuous (step<=0) range since matches()
+// already accepts any value in [min,max], the smallest qualifying set element, or the only value
+// an exact selector accepts. Callers are expected to have already checked dominates(req), so a
+// qualifying value exists; if req exceeds every value this selector can supply anyway, ceiling
+// falls back to upperBound.
+func (s *resourceSelector) ceiling(req resource.Quantity) resource.Quantity {
+	switch s.kind {
+	case selectorRange:
+		if req.Cmp(s.min) <= 0 {
+			return s.min
+		}
+		if s.step.MilliValue() <= 0 {
+			return req
+		}
+		steps := (req.MilliValue() - s.min.MilliValue()) / s.step.MilliValue()
+		if (req.MilliValue()-s.min.MilliValue())%s.step.MilliValue() != 0 {
+			steps++
+		}
+		q := resource.NewMilliQuantity(s.min.MilliValue()+steps*s.step.MilliValue(), req.Format)
+		if q.Cmp(s.max) > 0 {
+			return s.upperBound()
+		}
+		return *q
+	case selectorSet:
+		best := s.upperBound()
+		for _, v := range s.set {
+			if v.Cmp(req) >= 0 && v.Cmp(best) < 0 {
+				best = v
+			}
+		}
+		return best
+	default:
+		return s.exact
+	}
+}
+
+// flavorSpec is the set of resourceSelectors a flavor requires, keyed by resource dimension.
+type flavorSpec map[api.ResourceName]resourceSelector
+
+// flavorDef is a flavor's full definition: the required dimensions every matching request must
+// supply (filled in with defaults when omitted, exactly like flavorSpec always has), plus an
+// allow-list of extended resources -- GPUs, hugepages, ephemeral-storage -- a request carrying
+// that dimension must match but that are never required or defaulted in. A request naming any
+// dimension in neither set is rejected outright.
+//
+// It unmarshals from either a {"required", "extendedResources"} object, or -- for backward
+// compatibility with config files written before extended resources existed -- a flat dimension
+// map treated entirely as required, with no extended resources allowed.
+type flavorDef struct {
+	required flavorSpec
+	extended map[api.ResourceName]resourceSelector
+}
+
+func (d *flavorDef) UnmarshalJSON(data []byte) error {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+	_, hasRequired := probe["required"]
+	_, hasExtended := probe["extendedResources"]
+
+	if !hasRequired && !hasExtended {
+		var flat flavorSpec
+		if err := json.Unmarshal(data, &flat); err != nil {
+			return err
+		}
+		d.required = flat
+		return nil
+	}
+
+	var shaped struct {
+		Required          flavorSpec                            `json:"required"`
+		ExtendedResources map[api.ResourceName]resourceSelector `json:"extendedResources"`
+	}
+	if err := json.Unmarshal(data, &shaped); err != nil {
+		return err
+	}
+	d.required = shaped.Required
+	d.extended = shaped.ExtendedResources
+	return nil
+}
+
 type flavors struct {
-	Flavors map[flavorType]api.ResourceList
+	Version             int                          `json:"version"`
+	Flavors             map[flavorType]flavorDef     `json:"flavors"`
+	ClusterFlavorPolicy *ClusterFlavorPolicy         `json:"clusterFlavorPolicy,omitempty"`
+	MatchingPolicy      matchingPolicy               `json:"matchingPolicy,omitempty"`
+	SetLimitsFromFlavor bool                         `json:"setLimitsFromFlavor,omitempty"`
+	ResourceWeights     map[api.ResourceName]float64 `json:"resourceWeights,omitempty"`
+	Accounting          accountingMode               `json:"accounting,omitempty"`
+	PodFlavors          map[flavorType]flavorDef     `json:"podFlavors,omitempty"`
+}
+
+// ClusterFlavorPolicy restricts which flavors are permitted in which namespaces, in the same
+// spirit as OpenShift's ClusterResourceOverride plugin. Namespaces that no rule matches are
+// unrestricted.
+type ClusterFlavorPolicy struct {
+	Rules []NamespaceFlavorRule `json:"rules"`
 }
 
+// NamespaceFlavorRule matches namespaces either by explicit name or by label selector and
+// restricts them to a subset of the overall flavor catalog.
+type NamespaceFlavorRule struct {
+	// Name identifies this rule in error messages; defaults to "default policy" if empty.
+	Name string `json:"name,omitempty"`
+
+	Namespaces        []string          `json:"namespaces,omitempty"`
+	NamespaceSelector map[string]string `json:"namespaceSelector,omitempty"`
+
+	AllowedFlavors []flavorType `json:"allowedFlavors"`
+	DefaultFlavor  flavorType   `json:"defaultFlavor,omitempty"`
+}
+
+// rule returns the first rule matching ns, either by explicit name or by label selector, or nil
+// if no rule matches (meaning ns is unrestricted).
+func (cp *ClusterFlavorPolicy) rule(ns *api.Namespace) *NamespaceFlavorRule {
+	if cp == nil {
+		return nil
+	}
+	for i := range cp.Rules {
+		r := &cp.Rules[i]
+		for _, name := range r.Namespaces {
+			if name == ns.Name {
+				return r
+			}
+		}
+		if len(r.NamespaceSelector) > 0 {
+			if labels.SelectorFromSet(labels.Set(r.NamespaceSelector)).Matches(labels.Set(ns.Labels)) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// flavor holds its catalog behind an atomic.Value so Admit never blocks on the background
+// reloader in watchConfigFile, and a reload that fails to parse can never leave the plugin
+// without a usable catalog.
 type flavor struct {
 	*admission.Handler
-	flavors flavors
+	client  clientset.Interface
+	catalog atomic.Value // holds *flavors
+}
+
+// current returns the catalog currently in effect.
+func (f *flavor) current() *flavors {
+	return f.catalog.Load().(*flavors)
+}
+
+// List returns the flavor catalog currently in effect, so tests (and a future admission-webhook
+// wrapper) can inspect what this plugin would match a pod against.
+func (f *flavor) List() map[flavorType]flavorDef {
+	return f.current().Flavors
 }
 
 func (f *flavor) Admit(a admission.Attributes) error {
@@ -106,60 +537,393 @@ func (f *flavor) Admit(a admission.Attributes) error {
 		return nil
 	}
 
-	// check and fill requests against supported flavors
-	var found bool
 	pod := a.GetObject().(*api.Pod)
+	namespace := a.GetNamespace()
+	catalog := f.current()
+
+	if catalog.Accounting == AccountingPerPod {
+		return f.admitPerPod(catalog, pod, namespace)
+	}
+	return f.admitPerContainer(catalog, pod, namespace)
+}
+
+// admitPerContainer is today's matching mode: every container's request is matched against the
+// namespace-allowed flavors independently, and -- tracking each container's own outcome rather
+// than sharing a single result across the loop -- rejected as soon as any one of them fails.
+func (f *flavor) admitPerContainer(catalog *flavors, pod *api.Pod, namespace string) error {
+	allowed, rule, err := f.allowedFlavors(catalog, namespace)
+	if err != nil {
+		return err
+	}
+
+	// an explicit annotation always wins and requires an exact match against that one flavor
+	annotated := flavorType(pod.Annotations[flavorAnnotation])
+	if annotated != "" {
+		def, exists := allowed[annotated]
+		if !exists {
+			return fmt.Errorf("flavor %q is not permitted in namespace %q by policy %q (allowed: %v)", annotated, namespace, ruleName(rule), flavorNames(allowed))
+		}
+		allowed = map[flavorType]flavorDef{annotated: def}
+	}
+
+	policy := catalog.MatchingPolicy
+	if policy == MatchingNearest && pod.Annotations[disableNearestAnnotation] == "true" {
+		policy = MatchingStrict
+	}
+
 	for i := range pod.Spec.Containers {
 		container := &pod.Spec.Containers[i]
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = api.ResourceList{}
+		}
 		reqs := container.Resources.Requests
 
-		// if reqs is not specified, we will reject it
-		if len(reqs) == 0 {
-			break
+		containerAllowed := allowed
+		// A policy's default flavor is only a fallback for an empty, underspecified request; it
+		// must not override matching for a container whose request can otherwise be matched, so
+		// it only narrows containerAllowed, never the annotation-restricted allowed above.
+		if len(reqs) == 0 && annotated == "" {
+			if rule == nil || rule.DefaultFlavor == "" {
+				return fmt.Errorf("container %q in namespace %q specifies no resource requests", container.Name, namespace)
+			}
+			def, exists := allowed[rule.DefaultFlavor]
+			if !exists {
+				return fmt.Errorf("default flavor %q for namespace %q is not permitted by policy %q (allowed: %v)", rule.DefaultFlavor, namespace, ruleName(rule), flavorNames(allowed))
+			}
+			containerAllowed = map[flavorType]flavorDef{rule.DefaultFlavor: def}
 		}
 
-		for _, v := range f.flavors.Flavors {
-			if found = matchFlavor(v, reqs); found {
-				break
+		name, ok := selectFlavor(policy, containerAllowed, reqs, catalog.ResourceWeights)
+		if !ok {
+			return fmt.Errorf("container %q in namespace %q: request does not match any flavor allowed by policy %q under matching policy %q (allowed: %v)", container.Name, namespace, ruleName(rule), policy, flavorNames(containerAllowed))
+		}
+		if policy != MatchingStrict {
+			applyFlavor(container, containerAllowed[name], catalog.SetLimitsFromFlavor)
+		}
+	}
+
+	return nil
+}
+
+// admitPerPod implements AccountingPerPod: it computes the pod's aggregate resource usage with
+// kubelet's effective-resource semantics and validates (never mutates) it against podFlavors.
+// Namespace policy, the flavor annotation, and the matching policy apply only to per-container
+// accounting -- a pod-level flavor is either matched outright or it isn't.
+func (f *flavor) admitPerPod(catalog *flavors, pod *api.Pod, namespace string) error {
+	if len(catalog.PodFlavors) == 0 {
+		return fmt.Errorf("flavor: accounting is %q but no podFlavors are configured", AccountingPerPod)
+	}
+
+	aggregate := podResourceAggregate(pod)
+	if len(aggregate) == 0 {
+		return fmt.Errorf("pod %q in namespace %q specifies no resource requests to account for", pod.Name, namespace)
+	}
+
+	for _, name := range sortedFlavorNames(catalog.PodFlavors) {
+		if matchFlavor(catalog.PodFlavors[name], aggregate) {
+			return nil
+		}
+	}
+	return fmt.Errorf("pod %q in namespace %q: aggregate resource usage does not match any pod flavor (allowed: %v)", pod.Name, namespace, flavorNames(catalog.PodFlavors))
+}
+
+// podResourceAggregate computes the same effective resource usage the kubelet uses to size a
+// pod's sandbox: the max, dimension by dimension, across InitContainers (since init containers
+// run sequentially and never concurrently with each other), combined with the sum, dimension by
+// dimension, across regular Containers (which do run concurrently).
+func podResourceAggregate(pod *api.Pod) api.ResourceList {
+	initMax := api.ResourceList{}
+	for _, c := range pod.Spec.InitContainers {
+		for k, v := range c.Resources.Requests {
+			if cur, ok := initMax[k]; !ok || v.Cmp(cur) > 0 {
+				initMax[k] = v
 			}
 		}
 	}
 
-	if !found {
-		return fmt.Errorf("Request does not match any of the supported flavors")
+	aggregate := api.ResourceList{}
+	for _, c := range pod.Spec.Containers {
+		for k, v := range c.Resources.Requests {
+			if cur, ok := aggregate[k]; ok {
+				cur.Add(v)
+				aggregate[k] = cur
+			} else {
+				aggregate[k] = v
+			}
+		}
 	}
-	return nil
+
+	for k, v := range initMax {
+		if cur, ok := aggregate[k]; !ok || v.Cmp(cur) > 0 {
+			aggregate[k] = v
+		}
+	}
+	return aggregate
+}
+
+// selectFlavor picks which of the allowed flavors req should be matched against, per policy.
+// Under MatchingStrict, the chosen flavor's defaults are filled into req in place (via
+// matchFlavor) exactly as before this plugin could mutate resources. Under MatchingRoundUp and
+// MatchingNearest, the caller is expected to call applyFlavor with the result afterward.
+func selectFlavor(policy matchingPolicy, allowed map[flavorType]flavorDef, req api.ResourceList, weights map[api.ResourceName]float64) (flavorType, bool) {
+	switch policy {
+	case MatchingRoundUp:
+		return bestRoundUp(allowed, req)
+	case MatchingNearest:
+		return bestNearest(allowed, req, weights)
+	default:
+		return bestStrict(allowed, req)
+	}
+}
+
+// bestStrict returns the first (in a deterministic, sorted order) allowed flavor req exactly
+// matches, filling in req's unset dimensions from it as a side effect.
+func bestStrict(allowed map[flavorType]flavorDef, req api.ResourceList) (flavorType, bool) {
+	for _, name := range sortedFlavorNames(allowed) {
+		if matchFlavor(allowed[name], req) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// bestRoundUp returns the smallest allowed flavor that dominates req in every requested
+// dimension, i.e. the cheapest flavor that never reduces what the container asked for. Ties are
+// broken by flavor name so the outcome is deterministic.
+func bestRoundUp(allowed map[flavorType]flavorDef, req api.ResourceList) (flavorType, bool) {
+	var best flavorType
+	var bestSize int64
+	found := false
+	for _, name := range sortedFlavorNames(allowed) {
+		def := allowed[name]
+		if !dominates(def, req) {
+			continue
+		}
+		if size := flavorSize(def, req); !found || size < bestSize {
+			best, bestSize, found = name, size, true
+		}
+	}
+	return best, found
+}
+
+// bestNearest returns the allowed, dominating flavor with the smallest weighted distance from
+// req. Ties are broken by flavor name so the outcome is deterministic.
+func bestNearest(allowed map[flavorType]flavorDef, req api.ResourceList, weights map[api.ResourceName]float64) (flavorType, bool) {
+	var best flavorType
+	var bestDistance float64
+	found := false
+	for _, name := range sortedFlavorNames(allowed) {
+		def := allowed[name]
+		if !dominates(def, req) {
+			continue
+		}
+		if d := flavorDistance(def, req, weights); !found || d < bestDistance {
+			best, bestDistance, found = name, d, true
+		}
+	}
+	return best, found
 }
 
-func matchFlavor(flavor api.ResourceList, req api.ResourceList) bool {
-	resources := make(map[api.ResourceName]bool)
-	for k, _ := range flavor {
-		resources[k] = true
+// selector looks up the selector for dimension k in def, checking the required dimensions first
+// and then the extended resource allow-list.
+func (d flavorDef) selector(k api.ResourceName) (resourceSelector, bool) {
+	if sel, ok := d.required[k]; ok {
+		return sel, true
 	}
+	sel, ok := d.extended[k]
+	return sel, ok
+}
 
+// dominates reports whether every dimension req asks for is declared by def (required or
+// extended) and never smaller there, i.e. assigning def to req can only ever grow a container's
+// resources. This compares against each selector's upperBound -- the largest value it can ever
+// supply -- not defaultValue (its smallest/default value), since a range or set selector whose
+// upper end covers req still dominates it even though its default doesn't. Only def.required
+// dimensions factor into the RoundUp/Nearest size and distance comparisons below; extended
+// resources are validated here but otherwise along for the ride.
+func dominates(def flavorDef, req api.ResourceList) bool {
 	for k, v := range req {
-		glog.Infof("k = %v, v = %v\n", k, v)
-		fv, exists := flavor[k]
-		if !exists {
-			glog.Infof("%v does not exist\n", k)
+		sel, exists := def.selector(k)
+		if !exists || sel.upperBound().Cmp(v) < 0 {
 			return false
 		}
-		if fv.Cmp(v) != 0 {
-			glog.Infof("%v != %v\n", fv, v)
+	}
+	return true
+}
+
+// flavorSize sums def's ceiling values -- the smallest value each required dimension can supply
+// that still covers req -- across the required dimensions req asks for, so bestRoundUp can
+// compare candidate flavors that all dominate req by how much they actually cost to satisfy it.
+func flavorSize(def flavorDef, req api.ResourceList) int64 {
+	var total int64
+	for k, v := range req {
+		if sel, ok := def.required[k]; ok {
+			total += sel.ceiling(v).MilliValue()
+		}
+	}
+	return total
+}
+
+// flavorDistance is the weighted sum over req's required dimensions of (flavorVal-reqVal)/reqVal,
+// the relative amount def overshoots req by in that dimension, where flavorVal is the smallest
+// value the dimension's selector can supply that still covers req. A dimension with no configured
+// weight defaults to weight 1.
+func flavorDistance(def flavorDef, req api.ResourceList, weights map[api.ResourceName]float64) float64 {
+	var total float64
+	for k, v := range req {
+		sel, ok := def.required[k]
+		if !ok {
+			continue
+		}
+		reqMilli := float64(v.MilliValue())
+		if reqMilli == 0 {
+			continue
+		}
+		flavorMilli := float64(sel.ceiling(v).MilliValue())
+		weight := weights[k]
+		if weight == 0 {
+			weight = 1
+		}
+		total += weight * (flavorMilli - reqMilli) / reqMilli
+	}
+	return total
+}
+
+// applyFlavor mutates container's resource requests -- and, if setLimits, its limits -- to def's
+// required dimensions, rounding each dimension the container already requested up to the smallest
+// value its selector supplies that still covers the request (rather than unconditionally to the
+// selector's default/minimum), and otherwise filling in the selector's default. Any extended
+// resource value the request already specified is rounded the same way, via its own selector's
+// ceiling -- dominates only checked it against the selector's upperBound, not that it was itself a
+// legal value, so this is the step that actually brings it onto one. This is how MatchingRoundUp
+// and MatchingNearest upgrade a request to the chosen flavor's full resource tuple, rather than
+// just filling in the dimensions it omitted.
+func applyFlavor(container *api.Container, def flavorDef, setLimits bool) {
+	requests := make(api.ResourceList, len(def.required))
+	for k, sel := range def.required {
+		if v, ok := container.Resources.Requests[k]; ok {
+			requests[k] = sel.ceiling(v)
+		} else {
+			requests[k] = sel.defaultValue()
+		}
+	}
+	for k, v := range container.Resources.Requests {
+		if _, isRequired := def.required[k]; isRequired {
+			continue
+		}
+		if sel, isExtended := def.extended[k]; isExtended {
+			requests[k] = sel.ceiling(v)
+		}
+	}
+	container.Resources.Requests = requests
+
+	if setLimits {
+		limits := make(api.ResourceList, len(requests))
+		for k, v := range requests {
+			limits[k] = v
+		}
+		container.Resources.Limits = limits
+	}
+}
+
+// sortedFlavorNames returns allowed's keys in ascending order, so the bestRoundUp/bestNearest/
+// bestStrict selectors above break ties deterministically instead of depending on Go's randomized map
+// iteration order.
+func sortedFlavorNames(allowed map[flavorType]flavorDef) []flavorType {
+	names := make([]flavorType, 0, len(allowed))
+	for name := range allowed {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// allowedFlavors resolves which flavors a pod in namespace may match against. It returns the full
+// catalog and a nil rule when no ClusterFlavorPolicy is configured or no rule matches namespace.
+func (f *flavor) allowedFlavors(catalog *flavors, namespace string) (map[flavorType]flavorDef, *NamespaceFlavorRule, error) {
+	policy := catalog.ClusterFlavorPolicy
+	if policy == nil || namespace == "" {
+		return catalog.Flavors, nil, nil
+	}
+
+	ns, err := f.client.Core().Namespaces().Get(namespace)
+	if err != nil {
+		return nil, nil, fmt.Errorf("flavor: could not look up namespace %q to apply cluster flavor policy: %v", namespace, err)
+	}
+
+	rule := policy.rule(ns)
+	if rule == nil {
+		return catalog.Flavors, nil, nil
+	}
+
+	allowed := make(map[flavorType]flavorDef, len(rule.AllowedFlavors))
+	for _, name := range rule.AllowedFlavors {
+		if def, ok := catalog.Flavors[name]; ok {
+			allowed[name] = def
+		}
+	}
+	return allowed, rule, nil
+}
+
+func ruleName(rule *NamespaceFlavorRule) string {
+	if rule == nil || rule.Name == "" {
+		return "default policy"
+	}
+	return rule.Name
+}
+
+func flavorNames(defs map[flavorType]flavorDef) []string {
+	names := make([]string, 0, len(defs))
+	for name := range defs {
+		names = append(names, string(name))
+	}
+	return names
+}
+
+// matchFlavor reports whether req falls within def: every required dimension must be present
+// (after defaults are filled in) and match, every dimension req carries that def doesn't declare
+// as required must instead be declared as an extended resource and match there, and any dimension
+// in neither set is rejected outright.
+func matchFlavor(def flavorDef, req api.ResourceList) bool {
+	remaining := make(map[api.ResourceName]bool, len(def.required))
+	for k := range def.required {
+		remaining[k] = true
+	}
+
+	for k, v := range req {
+		selector, exists := def.required[k]
+		if !exists {
+			selector, exists = def.extended[k]
+			if !exists {
+				glog.Infof("%v is not a required or extended dimension of this flavor\n", k)
+				return false
+			}
+			if !selector.matches(v) {
+				glog.Infof("%v does not match extended resource selector for %v\n", v, k)
+				return false
+			}
+			continue
+		}
+		if !selector.matches(v) {
+			glog.Infof("%v does not match selector for %v\n", v, k)
 			return false
 		}
-		delete(resources, k)
+		delete(remaining, k)
 	}
 
-	for k, _ := range resources {
-		req[k] = flavor[k]
+	for k := range remaining {
+		req[k] = def.required[k].defaultValue()
 	}
 	return true
 }
 
-func NewFlavor(config io.Reader) admission.Interface {
+// NewFlavor builds the plugin from the location of the flavor catalog embedded in config. client
+// is used to look up namespaces when a ClusterFlavorPolicy restricts flavors by namespace. It
+// returns an error rather than calling glog.Fatalf so the apiserver's admission bootstrapping can
+// surface a clean failure instead of crashing the process.
+func NewFlavor(client clientset.Interface, config io.Reader) (admission.Interface, error) {
 	if config == nil {
-		glog.Fatalf("Flavor admission plugin requires `--admission-control-config-file` to be specified")
+		return nil, fmt.Errorf("Flavor admission plugin requires `--admission-control-config-file` to be specified")
 	}
 
 	// Scans config to get the location of the file describing all the supported flavors
@@ -178,23 +942,170 @@ func NewFlavor(config io.Reader) admission.Interface {
 	}
 
 	if flavorConfigFile == "" {
-		glog.Fatalf("Flavor admission plugin requires flavor config file to be specified in `--admission-control-config-file`")
+		return nil, fmt.Errorf("Flavor admission plugin requires flavor config file to be specified in `--admission-control-config-file`")
 	}
 
-	// Read the flavor config file and de-marshal
 	b, err := ioutil.ReadFile(flavorConfigFile)
 	if err != nil {
-		glog.Fatalf("Cannot read flavor config file '%s': %v", flavorConfigFile, err)
+		return nil, fmt.Errorf("cannot read flavor config file '%s': %v", flavorConfigFile, err)
 	}
 
-	var flavors flavors
-	err = json.NewDecoder(bytes.NewReader(b)).Decode(&flavors)
+	parsed, err := parseFlavors(b)
 	if err != nil {
-		glog.Fatalf("Cannot decode flavor config file '%s': %v", flavorConfigFile, err)
+		return nil, fmt.Errorf("cannot decode flavor config file '%s': %v", flavorConfigFile, err)
 	}
 
-	return &flavor{
+	f := &flavor{
 		Handler: admission.NewHandler(admission.Create, admission.Update),
-		flavors: flavors,
+		client:  client,
 	}
+	f.catalog.Store(parsed)
+
+	go f.watchConfigFile(flavorConfigFile)
+
+	return f, nil
+}
+
+// watchConfigFile watches the directory containing path and atomically swaps in a freshly parsed
+// catalog whenever path changes. It watches the directory rather than the file itself because
+// ConfigMap projections and most editors replace the file (rename+create) instead of writing it
+// in place, which some filesystems don't report as an event on the original inode. A reload that
+// fails to parse is logged and the previous catalog is kept rather than crashing the plugin.
+func (f *flavor) watchConfigFile(path string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		glog.Errorf("flavor: could not start fsnotify watcher, hot-reload of %s is disabled: %v", path, err)
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		glog.Errorf("flavor: could not watch %s, hot-reload of %s is disabled: %v", dir, path, err)
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if err := f.reload(path); err != nil {
+				glog.Errorf("flavor: keeping previous flavor catalog, failed to reload %s: %v", path, err)
+				continue
+			}
+			glog.Infof("flavor: reloaded flavor catalog from %s", path)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			glog.Errorf("flavor: fsnotify watcher error watching %s: %v", path, err)
+		}
+	}
+}
+
+// reload re-reads and re-validates path and, only on success, atomically swaps it in as the
+// catalog Admit matches against.
+func (f *flavor) reload(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	parsed, err := parseFlavors(b)
+	if err != nil {
+		return err
+	}
+	f.catalog.Store(parsed)
+	return nil
+}
+
+// parseFlavors decodes and validates a flavor config file. Files that omit "version" default to
+// version 1; resourceSelector.UnmarshalJSON accepts the version 1 exact-match shape regardless,
+// so version 1 files always continue to parse.
+func parseFlavors(b []byte) (*flavors, error) {
+	var f flavors
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&f); err != nil {
+		return nil, err
+	}
+	if f.Version == 0 {
+		f.Version = 1
+	}
+	if len(f.Flavors) == 0 {
+		return nil, fmt.Errorf("flavor config must define at least one flavor")
+	}
+	if err := checkDuplicateFlavorNames(b); err != nil {
+		return nil, err
+	}
+	if f.MatchingPolicy == "" {
+		f.MatchingPolicy = MatchingStrict
+	}
+	switch f.MatchingPolicy {
+	case MatchingStrict, MatchingRoundUp, MatchingNearest:
+	default:
+		return nil, fmt.Errorf("unknown matchingPolicy %q, must be one of %q, %q, %q", f.MatchingPolicy, MatchingStrict, MatchingRoundUp, MatchingNearest)
+	}
+	if f.Accounting == "" {
+		f.Accounting = AccountingPerContainer
+	}
+	switch f.Accounting {
+	case AccountingPerContainer:
+	case AccountingPerPod:
+		if len(f.PodFlavors) == 0 {
+			return nil, fmt.Errorf("accounting is %q but no podFlavors are defined", AccountingPerPod)
+		}
+	default:
+		return nil, fmt.Errorf("unknown accounting %q, must be one of %q, %q", f.Accounting, AccountingPerContainer, AccountingPerPod)
+	}
+	return &f, nil
+}
+
+// checkDuplicateFlavorNames rejects config files that define the same flavor name twice.
+// encoding/json silently keeps the last occurrence of a duplicate object key, so catching this
+// requires walking the raw token stream rather than just inspecting the decoded map.
+func checkDuplicateFlavorNames(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	depth := 0
+	flavorsDepth := -1
+	seen := make(map[string]bool)
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				depth++
+			} else {
+				depth--
+				if flavorsDepth != -1 && depth < flavorsDepth {
+					flavorsDepth = -1
+				}
+			}
+		case string:
+			if flavorsDepth == -1 && depth == 1 && t == "flavors" {
+				flavorsDepth = depth + 1
+				continue
+			}
+			if flavorsDepth != -1 && depth == flavorsDepth {
+				if seen[t] {
+					return fmt.Errorf("duplicate flavor name %q", t)
+				}
+				seen[t] = true
+			}
+		}
+	}
+	return nil
 }
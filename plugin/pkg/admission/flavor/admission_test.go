@@ -0,0 +1,753 @@
+package flavor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/admission"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/client/clientset_generated/internalclientset/fake"
+)
+
+func podAttributes(pod *api.Pod) admission.Attributes {
+	return admission.NewAttributesRecord(pod, nil, api.Kind("Pod").WithVersion("version"), pod.Namespace, pod.Name, api.Resource("pods").WithVersion("version"), "", admission.Create, nil)
+}
+
+func quantity(t *testing.T, s string) resource.Quantity {
+	t.Helper()
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		t.Fatalf("failed to parse quantity %q: %v", s, err)
+	}
+	return q
+}
+
+func TestParseFlavorsExactBackwardCompat(t *testing.T) {
+	config := []byte(`{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"}
+		}
+	}`)
+
+	fl, err := parseFlavors(config)
+	if err != nil {
+		t.Fatalf("unexpected error parsing version-1 (exact-only) config: %v", err)
+	}
+	if fl.Version != 1 {
+		t.Errorf("expected version to default to 1, got %d", fl.Version)
+	}
+	spec, ok := fl.Flavors["pico"]
+	if !ok {
+		t.Fatalf("expected flavor %q to be present", "pico")
+	}
+	if !matchFlavor(spec, api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")}) {
+		t.Errorf("expected exact match to succeed")
+	}
+}
+
+func TestMatchFlavorExact(t *testing.T) {
+	def := flavorDef{required: flavorSpec{
+		api.ResourceCPU:    {kind: selectorExact, exact: quantity(t, "100m")},
+		api.ResourceMemory: {kind: selectorExact, exact: quantity(t, "64Mi")},
+	}}
+
+	if !matchFlavor(def, api.ResourceList{api.ResourceCPU: quantity(t, "100m"), api.ResourceMemory: quantity(t, "64Mi")}) {
+		t.Errorf("expected exact match to succeed")
+	}
+	if matchFlavor(def, api.ResourceList{api.ResourceCPU: quantity(t, "200m"), api.ResourceMemory: quantity(t, "64Mi")}) {
+		t.Errorf("expected mismatched cpu to fail")
+	}
+}
+
+func TestMatchFlavorRange(t *testing.T) {
+	def := flavorDef{required: flavorSpec{
+		api.ResourceCPU: {kind: selectorRange, min: quantity(t, "1"), max: quantity(t, "4"), step: quantity(t, "1")},
+	}}
+
+	cases := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"below min", "500m", false},
+		{"at min", "1", true},
+		{"at max", "4", true},
+		{"above max", "5", false},
+		{"off step", "1500m", false},
+		{"on step", "3", true},
+	}
+	for _, c := range cases {
+		req := api.ResourceList{api.ResourceCPU: quantity(t, c.value)}
+		if got := matchFlavor(def, req); got != c.want {
+			t.Errorf("%s: matchFlavor(cpu=%s) = %v, want %v", c.name, c.value, got, c.want)
+		}
+	}
+}
+
+func TestMatchFlavorSet(t *testing.T) {
+	def := flavorDef{required: flavorSpec{
+		api.ResourceMemory: {kind: selectorSet, set: []resource.Quantity{quantity(t, "1Gi"), quantity(t, "2Gi"), quantity(t, "4Gi")}},
+	}}
+
+	if !matchFlavor(def, api.ResourceList{api.ResourceMemory: quantity(t, "2Gi")}) {
+		t.Errorf("expected memory=2Gi to be in the set")
+	}
+	if matchFlavor(def, api.ResourceList{api.ResourceMemory: quantity(t, "3Gi")}) {
+		t.Errorf("expected memory=3Gi to not be in the set")
+	}
+}
+
+func TestMatchFlavorFillsDefaults(t *testing.T) {
+	def := flavorDef{required: flavorSpec{
+		api.ResourceCPU:    {kind: selectorRange, min: quantity(t, "1"), max: quantity(t, "4"), step: quantity(t, "1")},
+		api.ResourceMemory: {kind: selectorSet, set: []resource.Quantity{quantity(t, "1Gi"), quantity(t, "2Gi")}},
+	}}
+
+	req := api.ResourceList{api.ResourceCPU: quantity(t, "2")}
+	if !matchFlavor(def, req) {
+		t.Fatalf("expected partial request to match")
+	}
+	mem, ok := req[api.ResourceMemory]
+	if !ok {
+		t.Fatalf("expected memory to be filled in")
+	}
+	if mem.Cmp(quantity(t, "1Gi")) != 0 {
+		t.Errorf("expected memory to default to the set's first element (1Gi), got %v", mem)
+	}
+}
+
+func TestMatchFlavorRejectsUnknownDimension(t *testing.T) {
+	def := flavorDef{required: flavorSpec{
+		api.ResourceCPU: {kind: selectorExact, exact: quantity(t, "100m")},
+	}}
+
+	req := api.ResourceList{
+		api.ResourceCPU:     quantity(t, "100m"),
+		api.ResourceStorage: quantity(t, "1Gi"),
+	}
+	if matchFlavor(def, req) {
+		t.Errorf("expected request with an undeclared dimension to be rejected")
+	}
+}
+
+func TestMatchFlavorExtendedResourceAllowList(t *testing.T) {
+	def := flavorDef{
+		required: flavorSpec{
+			api.ResourceCPU:    {kind: selectorExact, exact: quantity(t, "1")},
+			api.ResourceMemory: {kind: selectorExact, exact: quantity(t, "4096Mi")},
+		},
+		extended: map[api.ResourceName]resourceSelector{
+			"nvidia.com/gpu": {kind: selectorSet, set: []resource.Quantity{quantity(t, "1"), quantity(t, "2")}},
+		},
+	}
+
+	req := api.ResourceList{
+		api.ResourceCPU:    quantity(t, "1"),
+		api.ResourceMemory: quantity(t, "4096Mi"),
+		"nvidia.com/gpu":   quantity(t, "2"),
+	}
+	if !matchFlavor(def, req) {
+		t.Errorf("expected request for an allow-listed extended resource to match")
+	}
+
+	req["nvidia.com/gpu"] = quantity(t, "4")
+	if matchFlavor(def, req) {
+		t.Errorf("expected a gpu count outside the allow-listed set to be rejected")
+	}
+
+	delete(req, "nvidia.com/gpu")
+	req["hugepages-2Mi"] = quantity(t, "2Mi")
+	if matchFlavor(def, req) {
+		t.Errorf("expected a resource absent from both required and extendedResources to be rejected")
+	}
+}
+
+func TestResourceSelectorUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		name    string
+		data    string
+		wantErr bool
+		kind    resourceSelectorKind
+	}{
+		{"exact", `"100m"`, false, selectorExact},
+		{"range", `{"min":"1","max":"4","step":"1"}`, false, selectorRange},
+		{"set", `["1Gi","2Gi"]`, false, selectorSet},
+		{"empty set", `[]`, true, 0},
+		{"bad range", `{"min":"4","max":"1"}`, true, 0},
+		{"garbage", `{"foo":1}`, true, 0},
+	}
+	for _, c := range cases {
+		var s resourceSelector
+		err := json.Unmarshal([]byte(c.data), &s)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if s.kind != c.kind {
+			t.Errorf("%s: expected kind %v, got %v", c.name, c.kind, s.kind)
+		}
+	}
+}
+
+func TestParseFlavorsRejectsDuplicateNames(t *testing.T) {
+	config := []byte(`{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"pico": {"memory": "128Mi", "cpu": "100m"}
+		}
+	}`)
+
+	if _, err := parseFlavors(config); err == nil {
+		t.Errorf("expected duplicate flavor name %q to be rejected", "pico")
+	}
+}
+
+func writeFlavorConfig(t *testing.T, dir, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, "flavors.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("failed to write flavor config: %v", err)
+	}
+	return path
+}
+
+func TestFlavorHotReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flavor-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeFlavorConfig(t, dir, `{"flavors": {"pico": {"memory": "64Mi", "cpu": "100m"}}}`)
+
+	adm, err := NewFlavor(nil, strings.NewReader(FlavorConfigFile+"="+path))
+	if err != nil {
+		t.Fatalf("unexpected error from NewFlavor: %v", err)
+	}
+	f := adm.(*flavor)
+
+	if _, ok := f.List()["pico"]; !ok {
+		t.Fatalf("expected initial catalog to contain %q", "pico")
+	}
+	if _, ok := f.List()["nano"]; ok {
+		t.Fatalf("did not expect initial catalog to contain %q", "nano")
+	}
+
+	writeFlavorConfig(t, dir, `{"flavors": {"nano": {"memory": "128Mi", "cpu": "125m"}}}`)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := f.List()["nano"]; ok {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected catalog to hot-reload %q within the deadline", "nano")
+}
+
+func TestFlavorHotReloadKeepsPreviousCatalogOnInvalidUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flavor-test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeFlavorConfig(t, dir, `{"flavors": {"pico": {"memory": "64Mi", "cpu": "100m"}}}`)
+
+	adm, err := NewFlavor(nil, strings.NewReader(FlavorConfigFile+"="+path))
+	if err != nil {
+		t.Fatalf("unexpected error from NewFlavor: %v", err)
+	}
+	f := adm.(*flavor)
+
+	writeFlavorConfig(t, dir, `not valid json`)
+
+	time.Sleep(200 * time.Millisecond)
+
+	if _, ok := f.List()["pico"]; !ok {
+		t.Fatalf("expected catalog to keep %q after an invalid update", "pico")
+	}
+}
+
+func newFlavorForTest(t *testing.T, client *fake.Clientset, config string) *flavor {
+	t.Helper()
+	parsed, err := parseFlavors([]byte(config))
+	if err != nil {
+		t.Fatalf("failed to parse flavor config: %v", err)
+	}
+	f := &flavor{
+		Handler: admission.NewHandler(admission.Create, admission.Update),
+		client:  client,
+	}
+	f.catalog.Store(parsed)
+	return f
+}
+
+func TestAdmitClusterFlavorPolicyRestrictsByNamespaceSelector(t *testing.T) {
+	client := fake.NewSimpleClientset(&api.Namespace{
+		ObjectMeta: api.ObjectMeta{Name: "batch-ns", Labels: map[string]string{"team": "batch"}},
+	})
+	f := newFlavorForTest(t, client, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"large": {"memory": "4096Mi", "cpu": "1"}
+		},
+		"clusterFlavorPolicy": {
+			"rules": [
+				{"name": "batch-namespaces", "namespaceSelector": {"team": "batch"}, "allowedFlavors": ["pico"]}
+			]
+		}
+	}`)
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "p", Namespace: "batch-ns"},
+		Spec: api.PodSpec{Containers: []api.Container{{
+			Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "4096Mi"), api.ResourceCPU: quantity(t, "1")}},
+		}}},
+	}
+	if err := f.Admit(podAttributes(pod)); err == nil {
+		t.Errorf("expected large flavor to be rejected in a namespace restricted to pico")
+	}
+
+	pod.Spec.Containers[0].Resources.Requests = api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")}
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Errorf("expected pico flavor to be allowed in a namespace restricted to pico: %v", err)
+	}
+}
+
+func TestAdmitClusterFlavorPolicyDefaultFlavorIsOnlyAFallbackForEmptyRequests(t *testing.T) {
+	client := fake.NewSimpleClientset(&api.Namespace{ObjectMeta: api.ObjectMeta{Name: "batch-ns"}})
+	f := newFlavorForTest(t, client, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"nano": {"memory": "128Mi", "cpu": "125m"}
+		},
+		"clusterFlavorPolicy": {
+			"rules": [
+				{"name": "batch-namespaces", "namespaces": ["batch-ns"], "allowedFlavors": ["pico", "nano"], "defaultFlavor": "pico"}
+			]
+		}
+	}`)
+
+	// An unannotated pod that explicitly requests nano's exact resources must match nano, even
+	// though the namespace's policy sets pico as the default flavor: a default flavor is a
+	// fallback for an empty request, not an override for matching every pod in the namespace.
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "p", Namespace: "batch-ns"},
+		Spec: api.PodSpec{Containers: []api.Container{{
+			Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "128Mi"), api.ResourceCPU: quantity(t, "125m")}},
+		}}},
+	}
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Errorf("expected an explicit nano-shaped request to match nano despite pico being the namespace default: %v", err)
+	}
+
+	// A pod with no request at all falls back to the namespace default, pico.
+	emptyPod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "p2", Namespace: "batch-ns"},
+		Spec:       api.PodSpec{Containers: []api.Container{{}}},
+	}
+	if err := f.Admit(podAttributes(emptyPod)); err != nil {
+		t.Fatalf("unexpected error falling back to the default flavor for an empty request: %v", err)
+	}
+	reqs := emptyPod.Spec.Containers[0].Resources.Requests
+	if mem := reqs[api.ResourceMemory]; mem.Cmp(quantity(t, "64Mi")) != 0 {
+		t.Errorf("expected the empty request to be filled in from the default flavor pico (64Mi), got %v", mem)
+	}
+}
+
+func TestAdmitFlavorAnnotationRequiresExactMatchAndFillsDefaults(t *testing.T) {
+	client := fake.NewSimpleClientset(&api.Namespace{ObjectMeta: api.ObjectMeta{Name: "default"}})
+	f := newFlavorForTest(t, client, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"nano": {"memory": "128Mi", "cpu": "125m"}
+		}
+	}`)
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			Name:        "p",
+			Namespace:   "default",
+			Annotations: map[string]string{flavorAnnotation: "nano"},
+		},
+		Spec: api.PodSpec{Containers: []api.Container{{}}},
+	}
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error admitting pod annotated for the nano flavor: %v", err)
+	}
+	reqs := pod.Spec.Containers[0].Resources.Requests
+	if mem := reqs[api.ResourceMemory]; mem.Cmp(quantity(t, "128Mi")) != 0 {
+		t.Errorf("expected memory to be filled in from the nano flavor, got %v", mem)
+	}
+
+	pod.Spec.Containers[0].Resources.Requests = api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")}
+	if err := f.Admit(podAttributes(pod)); err == nil {
+		t.Errorf("expected pico-shaped request to be rejected when annotated for nano")
+	}
+}
+
+func TestAdmitClusterFlavorPolicyRejectsAnnotationOutsideAllowedSet(t *testing.T) {
+	client := fake.NewSimpleClientset(&api.Namespace{ObjectMeta: api.ObjectMeta{Name: "restricted"}})
+	f := newFlavorForTest(t, client, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"nano": {"memory": "128Mi", "cpu": "125m"}
+		},
+		"clusterFlavorPolicy": {
+			"rules": [
+				{"name": "restricted-policy", "namespaces": ["restricted"], "allowedFlavors": ["pico"]}
+			]
+		}
+	}`)
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			Name:        "p",
+			Namespace:   "restricted",
+			Annotations: map[string]string{flavorAnnotation: "nano"},
+		},
+		Spec: api.PodSpec{Containers: []api.Container{{}}},
+	}
+	err := f.Admit(podAttributes(pod))
+	if err == nil {
+		t.Fatalf("expected nano annotation to be rejected in a namespace restricted to pico")
+	}
+	if !strings.Contains(err.Error(), "restricted-policy") {
+		t.Errorf("expected error to name the policy, got: %v", err)
+	}
+}
+
+func multiContainerPod(requests ...api.ResourceList) *api.Pod {
+	containers := make([]api.Container, 0, len(requests))
+	for _, r := range requests {
+		containers = append(containers, api.Container{Resources: api.ResourceRequirements{Requests: r}})
+	}
+	return &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "p", Namespace: "default"},
+		Spec:       api.PodSpec{Containers: containers},
+	}
+}
+
+func TestAdmitRoundUpMutatesToSmallestDominatingFlavor(t *testing.T) {
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"nano": {"memory": "128Mi", "cpu": "125m"},
+			"large": {"memory": "4096Mi", "cpu": "1"}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{api.ResourceMemory: quantity(t, "100Mi"), api.ResourceCPU: quantity(t, "110m")})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reqs := pod.Spec.Containers[0].Resources.Requests
+	if mem := reqs[api.ResourceMemory]; mem.Cmp(quantity(t, "128Mi")) != 0 {
+		t.Errorf("expected RoundUp to pick the nano flavor's memory (128Mi), got %v", mem)
+	}
+	if cpu := reqs[api.ResourceCPU]; cpu.Cmp(quantity(t, "125m")) != 0 {
+		t.Errorf("expected RoundUp to pick the nano flavor's cpu (125m), got %v", cpu)
+	}
+}
+
+func TestAdmitRoundUpRejectsWhenNoFlavorDominates(t *testing.T) {
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {"pico": {"memory": "64Mi", "cpu": "100m"}},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{api.ResourceMemory: quantity(t, "128Mi"), api.ResourceCPU: quantity(t, "100m")})
+	if err := f.Admit(podAttributes(pod)); err == nil {
+		t.Errorf("expected rejection when no flavor dominates the request")
+	}
+}
+
+func TestAdmitRoundUpDominatesRangeFlavorByUpperBound(t *testing.T) {
+	// cpu=500m is on-step and inside [100m,1], so it matches this flavor outright under Strict;
+	// RoundUp must not reject it just because the range's default (its minimum, 100m) is smaller.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"elastic": {"cpu": {"min": "100m", "max": "1", "step": "100m"}, "memory": "512Mi"}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{api.ResourceMemory: quantity(t, "256Mi"), api.ResourceCPU: quantity(t, "500m")})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reqs := pod.Spec.Containers[0].Resources.Requests
+	if cpu := reqs[api.ResourceCPU]; cpu.Cmp(quantity(t, "500m")) != 0 {
+		t.Errorf("expected RoundUp to round cpu up to the smallest on-step value covering the request (500m), got %v", cpu)
+	}
+}
+
+func TestAdmitRoundUpContinuousRangeKeepsRequestValue(t *testing.T) {
+	// step<=0 makes this range continuous, so matches() already accepts any value in [min,max];
+	// RoundUp must snap cpu=200m to itself, not inflate it all the way to the range's max.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"elastic": {"cpu": {"min": "100m", "max": "4", "step": "0"}, "memory": "512Mi"}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{api.ResourceMemory: quantity(t, "256Mi"), api.ResourceCPU: quantity(t, "200m")})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cpu := pod.Spec.Containers[0].Resources.Requests[api.ResourceCPU]; cpu.Cmp(quantity(t, "200m")) != 0 {
+		t.Errorf("expected RoundUp to leave cpu at its own value on a continuous range (200m), got %v", cpu)
+	}
+}
+
+func TestAdmitRoundUpDominatesSetFlavorByLargestElement(t *testing.T) {
+	// memory=4Gi is a member of this flavor's set, so it matches outright under Strict; RoundUp
+	// must not reject it just because the set's default (its first element, 1Gi) is smaller.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"k8slice": {"memory": ["1Gi", "2Gi", "4Gi"], "cpu": "1"}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{api.ResourceMemory: quantity(t, "4Gi"), api.ResourceCPU: quantity(t, "1")})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mem := pod.Spec.Containers[0].Resources.Requests[api.ResourceMemory]; mem.Cmp(quantity(t, "4Gi")) != 0 {
+		t.Errorf("expected RoundUp to round memory up to the smallest set element covering the request (4Gi), got %v", mem)
+	}
+}
+
+func TestAdmitRoundUpWithExtendedResourceSetDominance(t *testing.T) {
+	// nvidia.com/gpu=2 is a member of this flavor's allow-listed set, so it is valid outright
+	// under Strict; RoundUp must not reject it just because the set's default (its first
+	// element, 1) is smaller than the request.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"gpu-large": {
+				"required": {"memory": "4096Mi", "cpu": "1"},
+				"extendedResources": {"nvidia.com/gpu": ["1", "2", "4"]}
+			}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{
+		api.ResourceMemory: quantity(t, "2048Mi"),
+		api.ResourceCPU:    quantity(t, "500m"),
+		"nvidia.com/gpu":   quantity(t, "2"),
+	})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gpu := pod.Spec.Containers[0].Resources.Requests["nvidia.com/gpu"]; gpu.Cmp(quantity(t, "2")) != 0 {
+		t.Errorf("expected the extended gpu request to be carried over unchanged, got %v", gpu)
+	}
+}
+
+func TestAdmitRoundUpRoundsExtendedResourceToSetMember(t *testing.T) {
+	// nvidia.com/gpu=3 is not itself a member of this flavor's allow-listed set, but it is
+	// <= the set's largest element (4), so dominates lets this flavor through; applyFlavor must
+	// round it up to 4 rather than admitting the pod with an illegal gpu=3 request.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"gpu-large": {
+				"required": {"memory": "4096Mi", "cpu": "1"},
+				"extendedResources": {"nvidia.com/gpu": ["1", "2", "4"]}
+			}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{
+		api.ResourceMemory: quantity(t, "2048Mi"),
+		api.ResourceCPU:    quantity(t, "500m"),
+		"nvidia.com/gpu":   quantity(t, "3"),
+	})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gpu := pod.Spec.Containers[0].Resources.Requests["nvidia.com/gpu"]; gpu.Cmp(quantity(t, "4")) != 0 {
+		t.Errorf("expected the extended gpu request to round up to the smallest set member covering it (4), got %v", gpu)
+	}
+}
+
+func TestAdmitRoundUpMultiContainerPod(t *testing.T) {
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"large": {"memory": "4096Mi", "cpu": "1"}
+		},
+		"matchingPolicy": "RoundUp"
+	}`)
+
+	pod := multiContainerPod(
+		api.ResourceList{api.ResourceMemory: quantity(t, "50Mi"), api.ResourceCPU: quantity(t, "50m")},
+		api.ResourceList{api.ResourceMemory: quantity(t, "2000Mi"), api.ResourceCPU: quantity(t, "500m")},
+	)
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mem := pod.Spec.Containers[0].Resources.Requests[api.ResourceMemory]; mem.Cmp(quantity(t, "64Mi")) != 0 {
+		t.Errorf("expected first container to round up to pico (64Mi), got %v", mem)
+	}
+	if mem := pod.Spec.Containers[1].Resources.Requests[api.ResourceMemory]; mem.Cmp(quantity(t, "4096Mi")) != 0 {
+		t.Errorf("expected second container to round up to large (4096Mi), got %v", mem)
+	}
+}
+
+func TestAdmitNearestPicksClosestDominatingFlavorAndSetsLimits(t *testing.T) {
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"nano": {"memory": "128Mi", "cpu": "125m"},
+			"large": {"memory": "4096Mi", "cpu": "1"}
+		},
+		"matchingPolicy": "Nearest",
+		"setLimitsFromFlavor": true
+	}`)
+
+	pod := multiContainerPod(api.ResourceList{api.ResourceMemory: quantity(t, "100Mi"), api.ResourceCPU: quantity(t, "110m")})
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reqs := pod.Spec.Containers[0].Resources.Requests
+	if mem := reqs[api.ResourceMemory]; mem.Cmp(quantity(t, "128Mi")) != 0 {
+		t.Errorf("expected Nearest to pick the nano flavor's memory (128Mi), got %v", mem)
+	}
+	limits := pod.Spec.Containers[0].Resources.Limits
+	if mem := limits[api.ResourceMemory]; mem.Cmp(quantity(t, "128Mi")) != 0 {
+		t.Errorf("expected setLimitsFromFlavor to set memory limit to 128Mi, got %v", mem)
+	}
+}
+
+func TestAdmitNearestTieBreaksByFlavorName(t *testing.T) {
+	// "pico-b" and "pico-a" both dominate the request with identical distance; the
+	// alphabetically first name must win so the outcome is deterministic.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"pico-b": {"memory": "64Mi", "cpu": "100m"},
+			"pico-a": {"memory": "64Mi", "cpu": "100m"}
+		},
+		"matchingPolicy": "Nearest"
+	}`)
+
+	allowed := f.List()
+	name, ok := bestNearest(allowed, api.ResourceList{api.ResourceMemory: quantity(t, "32Mi"), api.ResourceCPU: quantity(t, "50m")}, nil)
+	if !ok {
+		t.Fatalf("expected a dominating flavor to be found")
+	}
+	if name != "pico-a" {
+		t.Errorf("expected tie to be broken in favor of %q, got %q", "pico-a", name)
+	}
+}
+
+func TestAdmitNearestAnnotationOptOutFallsBackToStrict(t *testing.T) {
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {
+			"pico": {"memory": "64Mi", "cpu": "100m"},
+			"nano": {"memory": "128Mi", "cpu": "125m"}
+		},
+		"matchingPolicy": "Nearest"
+	}`)
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{
+			Name:        "p",
+			Namespace:   "default",
+			Annotations: map[string]string{disableNearestAnnotation: "true"},
+		},
+		Spec: api.PodSpec{Containers: []api.Container{{
+			Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "100Mi"), api.ResourceCPU: quantity(t, "110m")}},
+		}}},
+	}
+	if err := f.Admit(podAttributes(pod)); err == nil {
+		t.Errorf("expected opt-out pod with a non-exact request to be rejected under Strict fallback")
+	}
+}
+
+func TestAdmitPerContainerRejectsIfAnyContainerFails(t *testing.T) {
+	// Regression test: Admit used to share a single "found" result across the whole container
+	// loop, so a failure on an earlier container could be overwritten by a later container's
+	// success. Each container's own request must be checked independently.
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {"pico": {"memory": "64Mi", "cpu": "100m"}}
+	}`)
+
+	pod := multiContainerPod(
+		api.ResourceList{api.ResourceMemory: quantity(t, "999Mi"), api.ResourceCPU: quantity(t, "999m")},
+		api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")},
+	)
+	if err := f.Admit(podAttributes(pod)); err == nil {
+		t.Errorf("expected rejection when the first container's request matches no flavor, even though the second container's does")
+	}
+}
+
+func TestAdmitPerPodAggregatesAcrossContainers(t *testing.T) {
+	f := newFlavorForTest(t, nil, `{
+		"flavors": {"pico": {"memory": "64Mi", "cpu": "100m"}},
+		"accounting": "PerPod",
+		"podFlavors": {
+			"pod-small": {"memory": "128Mi", "cpu": "200m"}
+		}
+	}`)
+
+	pod := &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: "p", Namespace: "default"},
+		Spec: api.PodSpec{
+			InitContainers: []api.Container{
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "32Mi"), api.ResourceCPU: quantity(t, "50m")}}},
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")}}},
+			},
+			Containers: []api.Container{
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")}}},
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "64Mi"), api.ResourceCPU: quantity(t, "100m")}}},
+			},
+		},
+	}
+	// Aggregate: max(init) = 64Mi/100m, sum(containers) = 128Mi/200m, combined max = 128Mi/200m.
+	if err := f.Admit(podAttributes(pod)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pod.Spec.Containers[0].Resources.Requests[api.ResourceMemory] = quantity(t, "1024Mi")
+	if err := f.Admit(podAttributes(pod)); err == nil {
+		t.Errorf("expected an aggregate exceeding every pod flavor to be rejected")
+	}
+}
+
+func TestPodResourceAggregateMaxesInitAndSumsContainers(t *testing.T) {
+	pod := &api.Pod{
+		Spec: api.PodSpec{
+			InitContainers: []api.Container{
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "500Mi")}}},
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "100Mi")}}},
+			},
+			Containers: []api.Container{
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "50Mi")}}},
+				{Resources: api.ResourceRequirements{Requests: api.ResourceList{api.ResourceMemory: quantity(t, "50Mi")}}},
+			},
+		},
+	}
+	agg := podResourceAggregate(pod)
+	// max(init) = 500Mi, sum(containers) = 100Mi; the combined max is 500Mi.
+	if mem := agg[api.ResourceMemory]; mem.Cmp(quantity(t, "500Mi")) != 0 {
+		t.Errorf("expected aggregate memory to be max(init)=500Mi, got %v", mem)
+	}
+}